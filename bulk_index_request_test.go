@@ -0,0 +1,140 @@
+// Copyright 2012-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package elastic
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestBulkIndexRequestSource(t *testing.T) {
+	tests := []struct {
+		Request  *BulkIndexRequest
+		Expected []string
+	}{
+		{
+			Request:  NewBulkIndexRequest().Index("test").Type("doc").Id("1").Doc(struct{ Name string }{Name: "Olivere"}),
+			Expected: []string{`{"index":{"_id":"1","_index":"test","_type":"doc"}}`, `{"Name":"Olivere"}`},
+		},
+		{
+			// Legacy fields are still emitted when EsVersion is left unset.
+			Request:  NewBulkIndexRequest().Index("test").Type("doc").Id("1").Ttl(60).Timestamp("2020-01-01").Version(1).VersionType("external").Doc(nil),
+			Expected: []string{`{"index":{"_id":"1","_index":"test","_timestamp":"2020-01-01","_ttl":60,"_type":"doc","_version":1,"_version_type":"external"}}`, `{}`},
+		},
+		{
+			// _ttl/_timestamp are dropped from 5.0 on.
+			Request:  NewBulkIndexRequest().Index("test").Type("doc").Id("1").Ttl(60).Timestamp("2020-01-01").EsVersion(5).Doc(nil),
+			Expected: []string{`{"index":{"_id":"1","_index":"test","_type":"doc"}}`, `{}`},
+		},
+		{
+			// _type is still required on a stock 6.x cluster.
+			Request:  NewBulkIndexRequest().Index("test").Type("doc").Id("1").EsVersion(6).Doc(nil),
+			Expected: []string{`{"index":{"_id":"1","_index":"test","_type":"doc"}}`, `{}`},
+		},
+		{
+			// _type is dropped and if_seq_no/if_primary_term/pipeline show up on a typeless (7+) cluster.
+			Request:  NewBulkIndexRequest().Index("test").Type("doc").Id("1").EsVersion(7).IfSeqNo(3).IfPrimaryTerm(2).Pipeline("my-pipeline").Doc(nil),
+			Expected: []string{`{"index":{"_id":"1","_index":"test","if_primary_term":2,"if_seq_no":3,"pipeline":"my-pipeline"}}`, `{}`},
+		},
+		{
+			// Values with characters that need JSON escaping go through the slow path correctly.
+			Request:  NewBulkIndexRequest().Index("test").Type("doc").Id(`a"b\c`).Doc(nil),
+			Expected: []string{`{"index":{"_id":"a\"b\\c","_index":"test","_type":"doc"}}`, `{}`},
+		},
+	}
+
+	for i, tt := range tests {
+		lines, err := tt.Request.Source()
+		if err != nil {
+			t.Fatalf("#%d: Source returned error: %v", i, err)
+		}
+		if len(lines) != len(tt.Expected) {
+			t.Fatalf("#%d: expected %d lines, got %d: %v", i, len(tt.Expected), len(lines), lines)
+		}
+		for j, line := range lines {
+			if line != tt.Expected[j] {
+				t.Errorf("#%d: line %d: expected %s, got %s", i, j, tt.Expected[j], line)
+			}
+		}
+	}
+}
+
+// TestBulkIndexRequestWriteToMatchesSource asserts that WriteTo produces
+// the exact same wire bytes as Source, since WriteTo is meant to be a
+// drop-in, allocation-cheaper alternative.
+func TestBulkIndexRequestWriteToMatchesSource(t *testing.T) {
+	for i, r := range benchBulkIndexRequests()[:10] {
+		lines, err := r.Source()
+		if err != nil {
+			t.Fatalf("#%d: Source returned error: %v", i, err)
+		}
+		want := lines[0] + "\n" + lines[1] + "\n"
+
+		var buf bytes.Buffer
+		if _, err := r.WriteTo(&buf); err != nil {
+			t.Fatalf("#%d: WriteTo returned error: %v", i, err)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("#%d: WriteTo = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// benchBulkSize mirrors a typical high-throughput bulk flush.
+const benchBulkSize = 10000
+
+func benchBulkIndexRequests() []*BulkIndexRequest {
+	doc := map[string]interface{}{"user": "olivere", "message": "Hello, world"}
+	reqs := make([]*BulkIndexRequest, benchBulkSize)
+	for i := range reqs {
+		reqs[i] = NewBulkIndexRequest().
+			Index("test").
+			Type("doc").
+			Id(strconv.Itoa(i)).
+			Doc(doc)
+	}
+	return reqs
+}
+
+// BenchmarkBulkIndexRequestSource builds a 10k-doc bulk body the old way,
+// via Source, joining the resulting []string into a buffer.
+func BenchmarkBulkIndexRequestSource(b *testing.B) {
+	reqs := benchBulkIndexRequests()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var body bytes.Buffer
+		for _, r := range reqs {
+			r.source = nil
+			lines, err := r.Source()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, line := range lines {
+				body.WriteString(line)
+				body.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// BenchmarkBulkIndexRequestWriteTo builds the same 10k-doc bulk body via
+// WriteTo, streaming straight into the buffer.
+func BenchmarkBulkIndexRequestWriteTo(b *testing.B) {
+	reqs := benchBulkIndexRequests()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var body bytes.Buffer
+		for _, r := range reqs {
+			if _, err := r.WriteTo(&body); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}